@@ -2,6 +2,7 @@ package kt
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -9,8 +10,10 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 )
@@ -23,12 +26,88 @@ const DEFAULT_TIMEOUT = 2 * time.Second
 type Conn struct {
 	// Has to be first for atomic alignment
 	retryCount uint64
+	cursorSeq  uint64
 
 	timeout   time.Duration
 	host      string
+	scheme    string
 	transport *http.Transport
+
+	username string
+	password string
+
+	observer Observer
+}
+
+// Observer receives hooks for every RPC and REST call a Conn makes, for callers that want
+// metrics or tracing around KT calls. All methods must be safe for
+// concurrent use, since a Conn may be driven by many goroutines at once.
+type Observer interface {
+	// RPCStart is called when an RPC or REST operation begins. op
+	// identifies it, e.g. "/rpc/get_bulk" or "rest:GET".
+	RPCStart(op string)
+	// RPCEnd is called when op finishes, successfully or not, after dur
+	// has elapsed. code is the HTTP status code returned by KT, or 0 if
+	// the request never got a response. For RPCs, code is also 0 when the
+	// response body could not be read or decoded.
+	RPCEnd(op string, code int, err error, dur time.Duration)
+	// Retry is called each time op is retried after the remote end closed
+	// an idle connection, mirroring Conn.RetryCount.
+	Retry(op string)
+}
+
+// ConnObserver is an optional extension of Observer for callers that also
+// want net/http/httptrace-level visibility into connection reuse. See
+// TraceContext.
+type ConnObserver interface {
+	Observer
+	// GotConn is called once a connection has been obtained for a
+	// request; reused reports whether it came from the idle pool.
+	GotConn(reused bool)
+}
+
+// TraceContext returns a copy of ctx with an httptrace.ClientTrace
+// installed that reports connection-reuse to o, when o implements
+// ConnObserver. It's used internally for Conns configured with such an
+// observer, but is exported so callers can install the same trace on
+// contexts they build themselves.
+func TraceContext(ctx context.Context, o Observer) context.Context {
+	co, ok := o.(ConnObserver)
+	if !ok {
+		return ctx
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			co.GotConn(info.Reused)
+		},
+	})
+}
+
+// observeStart reports RPCStart to c.observer, if set, and returns a func
+// to call with the result once the operation completes. It's a no-op when
+// no observer is configured.
+func (c *Conn) observeStart(op string) func(code int, err error) {
+	if c.observer == nil {
+		return func(int, error) {}
+	}
+	c.observer.RPCStart(op)
+	start := time.Now()
+	return func(code int, err error) {
+		c.observer.RPCEnd(op, code, err, time.Since(start))
+	}
 }
 
+// defaultScanBatch is the number of records MatchPrefixStream pages
+// through a Cursor at a time when the caller doesn't open one itself.
+const defaultScanBatch = 256
+
+// cursorCloseTimeout bounds the cur_delete call Cursor.Close issues to
+// release the server-side cursor. It runs on its own context rather than
+// cur.ctx, since cur.ctx is typically already cancelled or expired by the
+// time Close is called (that's what stops iteration), and cur_delete over a
+// done context would fail immediately, leaking the cursor on the server.
+const cursorCloseTimeout = 5 * time.Second
+
 // KT has 2 interfaces, A restful one and an RPC one.
 // The RESTful interface is usually much faster than
 // the RPC one, but not all methods are implemented.
@@ -41,15 +120,66 @@ type Conn struct {
 // REST format is just the body of the HTTP request being the value.
 
 // NewConn creates a connection to an Kyoto Tycoon endpoint.
+//
+// It is a shim over NewConnWithConfig for callers who don't need a custom
+// transport, TLS, or authentication.
 func NewConn(host string, port int, poolsize int, timeout time.Duration) (*Conn, error) {
-	portstr := strconv.Itoa(port)
+	return NewConnWithConfig(Config{
+		Host:     host,
+		Port:     port,
+		PoolSize: poolsize,
+		Timeout:  timeout,
+	})
+}
+
+// Config holds the parameters for NewConnWithConfig.
+type Config struct {
+	Host     string
+	Port     int
+	PoolSize int
+	Timeout  time.Duration
+
+	// Transport, if set, is used instead of building one from PoolSize
+	// and Timeout. Set this to use TLS (e.g. talking to a stunnel-fronted
+	// KT), a custom dialer, HTTP/2, or a proxy.
+	Transport *http.Transport
+
+	// Scheme is "http" or "https". It defaults to "http".
+	Scheme string
+
+	// Username and Password, if set, are sent as HTTP Basic auth
+	// credentials on every request.
+	Username string
+	Password string
+
+	// Observer, if set, receives metrics/tracing hooks for every RPC and
+	// REST call made through the Conn.
+	Observer Observer
+}
+
+// NewConnWithConfig creates a connection to a Kyoto Tycoon endpoint using
+// the options in cfg.
+func NewConnWithConfig(cfg Config) (*Conn, error) {
+	scheme := cfg.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	transport := cfg.Transport
+	if transport == nil {
+		transport = &http.Transport{
+			ResponseHeaderTimeout: cfg.Timeout,
+			MaxIdleConnsPerHost:   cfg.PoolSize,
+		}
+	}
+	portstr := strconv.Itoa(cfg.Port)
 	c := &Conn{
-		timeout: timeout,
-		host:    net.JoinHostPort(host, portstr),
-		transport: &http.Transport{
-			ResponseHeaderTimeout: timeout,
-			MaxIdleConnsPerHost:   poolsize,
-		},
+		timeout:   cfg.Timeout,
+		host:      net.JoinHostPort(cfg.Host, portstr),
+		scheme:    scheme,
+		transport: transport,
+		username:  cfg.Username,
+		password:  cfg.Password,
+		observer:  cfg.Observer,
 	}
 
 	// connectivity check so that we can bail out
@@ -70,6 +200,9 @@ var (
 	// old gokabinet returned this error on success. Keeping around "for compatibility" until
 	// I can kill it with fire.
 	ErrSuccess = errors.New("kt: success")
+	// ErrCASFailed is returned by CAS when oval did not match the value
+	// currently stored at key.
+	ErrCASFailed = errors.New("kt: compare-and-swap failed")
 )
 
 // RetryCount is the number of retries performed due to the remote end
@@ -82,19 +215,34 @@ func (c *Conn) RetryCount() uint64 {
 
 // Count returns the number of records in the database
 func (c *Conn) Count() (int, error) {
-	code, m, err := c.doRPC("/rpc/status", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	return c.CountCtx(ctx)
+}
+
+// CountCtx is the context-aware equivalent of Count. The RPC is
+// cancelled as soon as ctx is done, instead of waiting for c.timeout.
+func (c *Conn) CountCtx(ctx context.Context) (int, error) {
+	code, m, err := c.doRPCCtx(ctx, "/rpc/status", nil)
 	if err != nil {
 		return 0, err
 	}
 	if code != 200 {
-		return 0, makeError(m)
+		return 0, makeError("/rpc/status", "", code, m)
 	}
 	return strconv.Atoi(string(findRec(m, "count").Value))
 }
 
 // Remove deletes the data at key in the database.
 func (c *Conn) Remove(key string) error {
-	code, body, err := c.doREST("DELETE", key, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	return c.RemoveCtx(ctx, key)
+}
+
+// RemoveCtx is the context-aware equivalent of Remove.
+func (c *Conn) RemoveCtx(ctx context.Context, key string) error {
+	code, body, err := c.doRESTCtx(ctx, "DELETE", key, nil)
 	if err != nil {
 		return err
 	}
@@ -142,7 +290,14 @@ func (c *Conn) Get(key string) (string, error) {
 // GetBytes retrieves the data stored at key in the format of a byte slice
 // ErrNotFound is returned if no such data is found.
 func (c *Conn) GetBytes(key string) ([]byte, error) {
-	code, body, err := c.doREST("GET", key, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	return c.GetCtx(ctx, key)
+}
+
+// GetCtx is the context-aware equivalent of GetBytes.
+func (c *Conn) GetCtx(ctx context.Context, key string) ([]byte, error) {
+	code, body, err := c.doRESTCtx(ctx, "GET", key, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -158,9 +313,66 @@ func (c *Conn) GetBytes(key string) ([]byte, error) {
 
 }
 
+// GetReader retrieves the data stored at key without buffering it into
+// memory, so callers can io.Copy it straight into a file, socket, or hasher.
+// ErrNotFound is returned if no such data exists. The returned ReadCloser
+// must be closed once the caller is done reading from it.
+//
+// GetReader does not apply c.timeout to the body read: the value may be
+// multi-MB and take arbitrarily long to stream, and a deadline attached via
+// req.WithContext would abort the copy partway through rather than just
+// bounding the wait for headers. Callers that need the read itself bounded
+// (or cancellable) should use GetReaderCtx with their own context.
+func (c *Conn) GetReader(key string) (io.ReadCloser, error) {
+	return c.getReader(context.Background(), key)
+}
+
+// GetReaderCtx is the context-aware equivalent of GetReader. Unlike the
+// other *Ctx methods, ctx must stay valid for as long as the caller reads
+// from the returned ReadCloser, since the request isn't complete until then.
+func (c *Conn) GetReaderCtx(ctx context.Context, key string) (io.ReadCloser, error) {
+	return c.getReader(ctx, key)
+}
+
+func (c *Conn) getReader(ctx context.Context, key string) (rc io.ReadCloser, err error) {
+	const op = "rest:GET-reader"
+	done := c.observeStart(op)
+	var code int
+	defer func() { done(code, err) }()
+
+	url := &url.URL{
+		Scheme: c.scheme,
+		Host:   c.host,
+		Opaque: urlenc(key),
+	}
+	resp, err := c.roundTripCtx(ctx, op, "GET", url, emptyHeader, nil)
+	if err != nil {
+		return nil, err
+	}
+	code = resp.StatusCode
+	switch code {
+	case 200:
+		return resp.Body, nil
+	case 404:
+		resp.Body.Close()
+		return nil, ErrNotFound
+	default:
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.New(string(body))
+	}
+}
+
 // Set stores the data at key
 func (c *Conn) Set(key string, value []byte) error {
-	code, body, err := c.doREST("PUT", key, value)
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	return c.SetCtx(ctx, key, value)
+}
+
+// SetCtx is the context-aware equivalent of Set.
+func (c *Conn) SetCtx(ctx context.Context, key string, value []byte) error {
+	code, body, err := c.doRESTCtx(ctx, "PUT", key, value)
 	if err != nil {
 		return err
 	}
@@ -171,11 +383,75 @@ func (c *Conn) Set(key string, value []byte) error {
 	return nil
 }
 
+// SetReader stores the size bytes read from r at key, without requiring the
+// caller to buffer the value into a []byte first. This is useful for
+// streaming uploads of multi-MB values.
+//
+// Unlike Set, a failed request is not retried, since r may not be safe to
+// read from twice. SetReader does not apply c.timeout to the upload: large
+// uploads may take arbitrarily long, and a deadline attached via
+// req.WithContext would abort the copy partway through rather than just
+// bounding the wait for headers. Callers that need the upload bounded (or
+// cancellable) should use SetReaderCtx with their own context.
+func (c *Conn) SetReader(key string, r io.Reader, size int64) error {
+	return c.SetReaderCtx(context.Background(), key, r, size)
+}
+
+// SetReaderCtx is the context-aware equivalent of SetReader.
+func (c *Conn) SetReaderCtx(ctx context.Context, key string, r io.Reader, size int64) (err error) {
+	const op = "rest:PUT-reader"
+	done := c.observeStart(op)
+	var code int
+	defer func() { done(code, err) }()
+
+	if c.observer != nil {
+		ctx = TraceContext(ctx, c.observer)
+	}
+	url := &url.URL{
+		Scheme: c.scheme,
+		Host:   c.host,
+		Opaque: urlenc(key),
+	}
+	req := &http.Request{
+		Method:        "PUT",
+		URL:           url,
+		Header:        emptyHeader,
+		Body:          ioutil.NopCloser(r),
+		ContentLength: size,
+	}
+	if c.username != "" {
+		req.Header = cloneHeader(emptyHeader)
+		req.SetBasicAuth(c.username, c.password)
+	}
+	req = req.WithContext(ctx)
+	resp, err := c.transport.RoundTrip(req)
+	if err != nil {
+		return translateCtxErr(ctx, err)
+	}
+	defer resp.Body.Close()
+	code = resp.StatusCode
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return translateCtxErr(ctx, err)
+	}
+	if resp.StatusCode != 201 {
+		return errors.New(string(body))
+	}
+	return nil
+}
+
 var zeroslice = []byte("0")
 
 // GetBulkBytes retrieves the keys in the map. The results will be filled in on function return.
 // If a key was not found in the database, it will be removed from the map.
 func (c *Conn) GetBulkBytes(keys map[string][]byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	return c.GetBulkBytesCtx(ctx, keys)
+}
+
+// GetBulkBytesCtx is the context-aware equivalent of GetBulkBytes.
+func (c *Conn) GetBulkBytesCtx(ctx context.Context, keys map[string][]byte) error {
 
 	// The format for querying multiple keys in KT is to send a
 	// TSV value for each key with a _ as a prefix.
@@ -188,12 +464,12 @@ func (c *Conn) GetBulkBytes(keys map[string][]byte) error {
 		keys[k] = nil
 		keystransmit = append(keystransmit, KV{"_" + k, zeroslice})
 	}
-	code, m, err := c.doRPC("/rpc/get_bulk", keystransmit)
+	code, m, err := c.doRPCCtx(ctx, "/rpc/get_bulk", keystransmit)
 	if err != nil {
 		return err
 	}
 	if code != 200 {
-		return makeError(m)
+		return makeError("/rpc/get_bulk", "", code, m)
 	}
 	for _, kv := range m {
 		if kv.Key[0] != '_' {
@@ -211,51 +487,207 @@ func (c *Conn) GetBulkBytes(keys map[string][]byte) error {
 
 // SetBulk stores the values in the map.
 func (c *Conn) SetBulk(values map[string]string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	return c.SetBulkCtx(ctx, values)
+}
+
+// SetBulkCtx is the context-aware equivalent of SetBulk.
+func (c *Conn) SetBulkCtx(ctx context.Context, values map[string]string) (int64, error) {
 	vals := make([]KV, 0, len(values))
 	for k, v := range values {
 		vals = append(vals, KV{"_" + k, []byte(v)})
 	}
-	code, m, err := c.doRPC("/rpc/set_bulk", vals)
+	code, m, err := c.doRPCCtx(ctx, "/rpc/set_bulk", vals)
 	if err != nil {
 		return 0, err
 	}
 	if code != 200 {
-		return 0, makeError(m)
+		return 0, makeError("/rpc/set_bulk", "", code, m)
 	}
 	return strconv.ParseInt(string(findRec(m, "num").Value), 10, 64)
 }
 
 // RemoveBulk deletes the values
 func (c *Conn) RemoveBulk(keys []string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	return c.RemoveBulkCtx(ctx, keys)
+}
+
+// RemoveBulkCtx is the context-aware equivalent of RemoveBulk.
+func (c *Conn) RemoveBulkCtx(ctx context.Context, keys []string) (int64, error) {
 	vals := make([]KV, 0, len(keys))
 	for _, k := range keys {
 		vals = append(vals, KV{"_" + k, zeroslice})
 	}
-	code, m, err := c.doRPC("/rpc/remove_bulk", vals)
+	code, m, err := c.doRPCCtx(ctx, "/rpc/remove_bulk", vals)
+	if err != nil {
+		return 0, err
+	}
+	if code != 200 {
+		return 0, makeError("/rpc/remove_bulk", "", code, m)
+	}
+	return strconv.ParseInt(string(findRec(m, "num").Value), 10, 64)
+}
+
+// Increment adds num to the integer stored at key, creating it if
+// necessary, and returns the new value.
+func (c *Conn) Increment(key string, num int64) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	return c.IncrementCtx(ctx, key, num)
+}
+
+// IncrementCtx is the context-aware equivalent of Increment.
+func (c *Conn) IncrementCtx(ctx context.Context, key string, num int64) (int64, error) {
+	code, m, err := c.doRPCCtx(ctx, "/rpc/increment", []KV{
+		{"key", []byte(key)},
+		{"num", []byte(strconv.FormatInt(num, 10))},
+	})
 	if err != nil {
 		return 0, err
 	}
 	if code != 200 {
-		return 0, makeError(m)
+		return 0, makeError("/rpc/increment", key, code, m)
 	}
 	return strconv.ParseInt(string(findRec(m, "num").Value), 10, 64)
 }
 
+// IncrementDouble adds num to the floating point number stored at key,
+// creating it if necessary, and returns the new value.
+func (c *Conn) IncrementDouble(key string, num float64) (float64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	return c.IncrementDoubleCtx(ctx, key, num)
+}
+
+// IncrementDoubleCtx is the context-aware equivalent of IncrementDouble.
+func (c *Conn) IncrementDoubleCtx(ctx context.Context, key string, num float64) (float64, error) {
+	code, m, err := c.doRPCCtx(ctx, "/rpc/increment_double", []KV{
+		{"key", []byte(key)},
+		{"num", []byte(strconv.FormatFloat(num, 'g', -1, 64))},
+	})
+	if err != nil {
+		return 0, err
+	}
+	if code != 200 {
+		return 0, makeError("/rpc/increment_double", key, code, m)
+	}
+	return strconv.ParseFloat(string(findRec(m, "num").Value), 64)
+}
+
+// Append adds value to the end of the record stored at key, creating it
+// if necessary.
+func (c *Conn) Append(key string, value []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	return c.AppendCtx(ctx, key, value)
+}
+
+// AppendCtx is the context-aware equivalent of Append.
+func (c *Conn) AppendCtx(ctx context.Context, key string, value []byte) error {
+	code, m, err := c.doRPCCtx(ctx, "/rpc/append", []KV{
+		{"key", []byte(key)},
+		{"value", value},
+	})
+	if err != nil {
+		return err
+	}
+	if code != 200 {
+		return makeError("/rpc/append", key, code, m)
+	}
+	return nil
+}
+
+// CAS atomically replaces oval with nval at key, failing with ErrCASFailed
+// if the value currently stored there doesn't match oval. A nil oval
+// requires that key not already exist, and a nil nval removes key instead
+// of replacing its value.
+func (c *Conn) CAS(key string, oval, nval []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	return c.CASCtx(ctx, key, oval, nval)
+}
+
+// CASCtx is the context-aware equivalent of CAS.
+func (c *Conn) CASCtx(ctx context.Context, key string, oval, nval []byte) error {
+	vals := []KV{{"key", []byte(key)}}
+	if oval != nil {
+		vals = append(vals, KV{"oval", oval})
+	}
+	if nval != nil {
+		vals = append(vals, KV{"nval", nval})
+	}
+	code, m, err := c.doRPCCtx(ctx, "/rpc/cas", vals)
+	if err != nil {
+		return err
+	}
+	if code == 450 {
+		return ErrCASFailed
+	}
+	if code != 200 {
+		return makeError("/rpc/cas", key, code, m)
+	}
+	return nil
+}
+
+// PlayScript invokes the server-side Lua script function name, passing
+// params and returning whatever key/value pairs it produces.
+func (c *Conn) PlayScript(name string, params map[string][]byte) ([]KV, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	return c.PlayScriptCtx(ctx, name, params)
+}
+
+// PlayScriptCtx is the context-aware equivalent of PlayScript.
+func (c *Conn) PlayScriptCtx(ctx context.Context, name string, params map[string][]byte) ([]KV, error) {
+	// Like get_bulk/set_bulk, script params and results are carried as
+	// TSV fields prefixed with _ to keep them out of the way of KT's own
+	// named fields (name, ERROR, ...).
+	vals := make([]KV, 0, len(params)+1)
+	vals = append(vals, KV{"name", []byte(name)})
+	for k, v := range params {
+		vals = append(vals, KV{"_" + k, v})
+	}
+	code, m, err := c.doRPCCtx(ctx, "/rpc/play_script", vals)
+	if err != nil {
+		return nil, err
+	}
+	if code != 200 {
+		return nil, makeError("/rpc/play_script", name, code, m)
+	}
+	res := make([]KV, 0, len(m))
+	for _, kv := range m {
+		if len(kv.Key) > 0 && kv.Key[0] == '_' {
+			res = append(res, KV{kv.Key[1:], kv.Value})
+		}
+	}
+	return res, nil
+}
+
 // MatchPrefix performs the match_prefix operation against the server
 // It returns a sorted list of strings.
 // The error may be ErrSuccess in the case that no records were found.
 // This is for compatibility with the old gokabinet library.
 func (c *Conn) MatchPrefix(key string, maxrecords int64) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	return c.MatchPrefixCtx(ctx, key, maxrecords)
+}
+
+// MatchPrefixCtx is the context-aware equivalent of MatchPrefix.
+func (c *Conn) MatchPrefixCtx(ctx context.Context, key string, maxrecords int64) ([]string, error) {
 	keystransmit := []KV{
 		{"prefix", []byte(key)},
 		{"max", []byte(strconv.FormatInt(maxrecords, 10))},
 	}
-	code, m, err := c.doRPC("/rpc/match_prefix", keystransmit)
+	code, m, err := c.doRPCCtx(ctx, "/rpc/match_prefix", keystransmit)
 	if err != nil {
 		return nil, err
 	}
 	if code != 200 {
-		return nil, makeError(m)
+		return nil, makeError("/rpc/match_prefix", key, code, m)
 	}
 	res := make([]string, 0, len(m))
 	for _, kv := range m {
@@ -270,6 +702,209 @@ func (c *Conn) MatchPrefix(key string, maxrecords int64) ([]string, error) {
 	return res, nil
 }
 
+// MatchPrefixStream invokes fn once per key matching prefix, stopping early
+// if fn returns false. Unlike MatchPrefix, it pages through the server via a
+// Cursor rather than materializing every match in one response, so it can be
+// used on prefixes that match millions of keys without buffering them all in
+// memory.
+func (c *Conn) MatchPrefixStream(prefix string, fn func(key string) bool) error {
+	cur := c.Scan(prefix, defaultScanBatch)
+	defer cur.Close()
+	for cur.Next() {
+		if !fn(cur.Key()) {
+			break
+		}
+	}
+	return cur.Err()
+}
+
+// Scan opens a Cursor that pages through the keys matching prefix in
+// batchSize chunks, rather than loading every match into memory at once the
+// way MatchPrefix does.
+//
+// Scan relies on KT returning keys in sorted order when jumping to prefix,
+// so it only makes sense against a tree database (kct/ktree); against a hash
+// database the iteration order is undefined.
+func (c *Conn) Scan(prefix string, batchSize int) *Cursor {
+	return c.ScanCtx(context.Background(), prefix, batchSize)
+}
+
+// ScanCtx is the context-aware equivalent of Scan. ctx bounds the whole
+// iteration, not just a single RPC: cancelling it stops the Cursor wherever
+// it is and causes subsequent Next calls to return false.
+func (c *Conn) ScanCtx(ctx context.Context, prefix string, batchSize int) *Cursor {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	return &Cursor{
+		conn:      c,
+		ctx:       ctx,
+		id:        int64(atomic.AddUint64(&c.cursorSeq, 1)),
+		prefix:    prefix,
+		batchSize: batchSize,
+	}
+}
+
+// Cursor iterates over the keys matching a prefix, fetching them from the
+// server in batchSize chunks via KT's cur_jump/cur_get RPCs instead of
+// requiring the whole match set to be buffered up front. A Cursor is not
+// safe for concurrent use.
+type Cursor struct {
+	conn      *Conn
+	ctx       context.Context
+	id        int64
+	prefix    string
+	batchSize int
+
+	started   bool
+	exhausted bool
+	err       error
+	buf       []KV
+	idx       int
+}
+
+// Next advances the Cursor to the next matching key, fetching another batch
+// from the server when the current one is exhausted. It returns false once
+// there are no more matches or an error occurred; check Err to tell the two
+// apart.
+func (cur *Cursor) Next() bool {
+	if cur.err != nil || cur.exhausted {
+		return false
+	}
+	if cur.ctx.Err() != nil {
+		cur.err = ErrTimeout
+		return false
+	}
+	if !cur.started {
+		cur.started = true
+		if err := cur.conn.curJumpCtx(cur.ctx, cur.id, cur.prefix); err != nil {
+			if err != ErrNotFound {
+				cur.err = err
+			}
+			cur.exhausted = true
+			return false
+		}
+	}
+	if cur.idx+1 < len(cur.buf) {
+		cur.idx++
+		return true
+	}
+	cur.fetchBatch()
+	if cur.err != nil {
+		return false
+	}
+	if len(cur.buf) == 0 {
+		cur.exhausted = true
+		return false
+	}
+	cur.idx = 0
+	return true
+}
+
+// fetchBatch refills buf with up to batchSize records starting from the
+// cursor's current server-side position, stopping early if a key no longer
+// matches prefix or the cursor runs off the end of the database.
+func (cur *Cursor) fetchBatch() {
+	buf := cur.buf[:0]
+	for len(buf) < cur.batchSize {
+		key, value, err := cur.conn.curGetCtx(cur.ctx, cur.id)
+		if err != nil {
+			if err != ErrNotFound {
+				cur.err = err
+			}
+			break
+		}
+		if !strings.HasPrefix(key, cur.prefix) {
+			break
+		}
+		buf = append(buf, KV{key, value})
+	}
+	cur.buf = buf
+}
+
+// Key returns the key at the Cursor's current position. It is only valid
+// after a call to Next has returned true.
+func (cur *Cursor) Key() string {
+	return cur.buf[cur.idx].Key
+}
+
+// Value returns the value at the Cursor's current position. It is only
+// valid after a call to Next has returned true.
+func (cur *Cursor) Value() []byte {
+	return cur.buf[cur.idx].Value
+}
+
+// Err returns the first error encountered during iteration, if any. It
+// should be checked once Next returns false.
+func (cur *Cursor) Err() error {
+	return cur.err
+}
+
+// Close releases the cursor object held open on the server. Callers should
+// always call Close once they are done with a Cursor, even if iteration
+// stopped early.
+//
+// Close deliberately does not use cur.ctx: if iteration stopped because
+// cur.ctx was cancelled or its deadline passed, cur_delete run on that same
+// context would fail immediately without ever reaching the server, leaking
+// the cursor there until it times out on its own.
+func (cur *Cursor) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), cursorCloseTimeout)
+	defer cancel()
+	return cur.conn.curDeleteCtx(ctx, cur.id)
+}
+
+// curJumpCtx positions cursor id at the first key >= prefix via /rpc/cur_jump.
+func (c *Conn) curJumpCtx(ctx context.Context, id int64, prefix string) error {
+	code, m, err := c.doRPCCtx(ctx, "/rpc/cur_jump", []KV{
+		{"CUR", []byte(strconv.FormatInt(id, 10))},
+		{"key", []byte(prefix)},
+	})
+	if err != nil {
+		return err
+	}
+	if code == 450 {
+		return ErrNotFound
+	}
+	if code != 200 {
+		return makeError("/rpc/cur_jump", prefix, code, m)
+	}
+	return nil
+}
+
+// curGetCtx fetches the record cursor id currently points at and advances it
+// to the next one via /rpc/cur_get.
+func (c *Conn) curGetCtx(ctx context.Context, id int64) (key string, value []byte, err error) {
+	code, m, err := c.doRPCCtx(ctx, "/rpc/cur_get", []KV{
+		{"CUR", []byte(strconv.FormatInt(id, 10))},
+		{"step", zeroslice},
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if code == 450 {
+		return "", nil, ErrNotFound
+	}
+	if code != 200 {
+		return "", nil, makeError("/rpc/cur_get", strconv.FormatInt(id, 10), code, m)
+	}
+	return string(findRec(m, "key").Value), findRec(m, "value").Value, nil
+}
+
+// curDeleteCtx releases cursor id on the server via /rpc/cur_delete.
+func (c *Conn) curDeleteCtx(ctx context.Context, id int64) error {
+	code, m, err := c.doRPCCtx(ctx, "/rpc/cur_delete", []KV{
+		{"CUR", []byte(strconv.FormatInt(id, 10))},
+	})
+	if err != nil {
+		return err
+	}
+	if code != 200 && code != 450 {
+		return makeError("/rpc/cur_delete", strconv.FormatInt(id, 10), code, m)
+	}
+	return nil
+}
+
 var base64headers http.Header
 var identityheaders http.Header
 
@@ -287,10 +922,20 @@ type KV struct {
 	Value []byte
 }
 
-// Do an RPC call against the KT endpoint.
+// Do an RPC call against the KT endpoint, bounded by c.timeout.
 func (c *Conn) doRPC(path string, values []KV) (code int, vals []KV, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	return c.doRPCCtx(ctx, path, values)
+}
+
+// doRPCCtx is the context-aware equivalent of doRPC.
+func (c *Conn) doRPCCtx(ctx context.Context, path string, values []KV) (code int, vals []KV, err error) {
+	done := c.observeStart(path)
+	defer func() { done(code, err) }()
+
 	url := &url.URL{
-		Scheme: "http",
+		Scheme: c.scheme,
 		Host:   c.host,
 		Path:   path,
 	}
@@ -299,17 +944,14 @@ func (c *Conn) doRPC(path string, values []KV) (code int, vals []KV, err error)
 	if enc == Base64Enc {
 		headers = base64headers
 	}
-	resp, t, err := c.roundTrip("POST", url, headers, body)
+	resp, err := c.roundTripCtx(ctx, path, "POST", url, headers, body)
 	if err != nil {
 		return 0, nil, err
 	}
 	resultBody, err := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
-	if !t.Stop() {
-		return 0, nil, ErrTimeout
-	}
 	if err != nil {
-		return 0, nil, err
+		return 0, nil, translateCtxErr(ctx, err)
 	}
 	m, err := DecodeValues(resultBody, resp.Header.Get("Content-Type"))
 	if err != nil {
@@ -318,28 +960,33 @@ func (c *Conn) doRPC(path string, values []KV) (code int, vals []KV, err error)
 	return resp.StatusCode, m, nil
 }
 
-func (c *Conn) roundTrip(method string, url *url.URL, headers http.Header, body []byte) (*http.Response, *time.Timer, error) {
-	req, t := c.makeRequest(method, url, headers, body)
+// roundTripCtx sends a request, retrying it once if it fails. Cancellation
+// and deadlines are carried by ctx rather than an eagerly-armed timer that
+// has to be stopped exactly once.
+func (c *Conn) roundTripCtx(ctx context.Context, op, method string, url *url.URL, headers http.Header, body []byte) (*http.Response, error) {
+	if c.observer != nil {
+		ctx = TraceContext(ctx, c.observer)
+	}
+	req := c.makeRequestCtx(ctx, method, url, headers, body)
 	resp, err := c.transport.RoundTrip(req)
 	if err != nil {
 		// Ideally we would only retry when we hit a network error. This doesn't work
 		// since net/http wraps some of these errors. Do the simple thing and retry eagerly.
-		t.Stop()
 		c.transport.CloseIdleConnections()
-		req, t = c.makeRequest(method, url, headers, body)
+		if c.observer != nil {
+			c.observer.Retry(op)
+		}
+		req = c.makeRequestCtx(ctx, method, url, headers, body)
 		resp, err = c.transport.RoundTrip(req)
 		atomic.AddUint64(&c.retryCount, 1)
 	}
 	if err != nil {
-		if !t.Stop() {
-			err = ErrTimeout
-		}
-		return nil, nil, err
+		return nil, translateCtxErr(ctx, err)
 	}
-	return resp, t, nil
+	return resp, nil
 }
 
-func (c *Conn) makeRequest(method string, url *url.URL, headers http.Header, body []byte) (*http.Request, *time.Timer) {
+func (c *Conn) makeRequestCtx(ctx context.Context, method string, url *url.URL, headers http.Header, body []byte) *http.Request {
 	var rc io.ReadCloser
 	if body != nil {
 		rc = ioutil.NopCloser(bytes.NewReader(body))
@@ -351,10 +998,31 @@ func (c *Conn) makeRequest(method string, url *url.URL, headers http.Header, bod
 		Body:          rc,
 		ContentLength: int64(len(body)),
 	}
-	t := time.AfterFunc(c.timeout, func() {
-		c.transport.CancelRequest(req)
-	})
-	return req, t
+	if c.username != "" {
+		// headers is one of our shared package-level Header values, so it
+		// must be cloned before SetBasicAuth mutates it in place.
+		req.Header = cloneHeader(headers)
+		req.SetBasicAuth(c.username, c.password)
+	}
+	return req.WithContext(ctx)
+}
+
+func cloneHeader(h http.Header) http.Header {
+	nh := make(http.Header, len(h)+1)
+	for k, v := range h {
+		nh[k] = v
+	}
+	return nh
+}
+
+// translateCtxErr turns the net/http error produced when ctx is done into
+// the ErrTimeout callers already know how to handle, and passes through
+// anything else unchanged.
+func translateCtxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ErrTimeout
+	}
+	return err
 }
 
 type Encoding int
@@ -536,14 +1204,31 @@ func unhex(c byte) byte {
 	return 0
 }
 
-// TODO: make this return errors that can be introspected more easily
-// and make it trim components of the error to filter out unused information.
-func makeError(m []KV) error {
+// Error is returned when KT responds to an RPC with a non-success code.
+// Unlike substring-matching the message (e.g. for "logical
+// inconsistency"), callers can errors.As into an *Error and branch on Raw.
+// REST calls (Get, Set, Remove, ...) do not return an *Error.
+type Error struct {
+	Op     string // the RPC path that failed, e.g. "/rpc/cas"
+	Key    string // the key, prefix, script name or cursor ID the RPC was about, if any
+	Status int    // the HTTP status code KT responded with
+	Raw    string // KT's raw ERROR field, e.g. "no record" or "invalid operation"; "generic error" if there was none
+}
+
+func (e *Error) Error() string {
+	if e.Key != "" {
+		return fmt.Sprintf("kt: %s %q: %s", e.Op, e.Key, e.Raw)
+	}
+	return fmt.Sprintf("kt: %s: %s", e.Op, e.Raw)
+}
+
+func makeError(op, key string, status int, m []KV) error {
 	kv := findRec(m, "ERROR")
+	raw := string(kv.Value)
 	if kv.Key == "" {
-		return errors.New("kt: generic error")
+		raw = "generic error"
 	}
-	return errors.New("kt: " + string(kv.Value))
+	return &Error{Op: op, Key: key, Status: status, Raw: raw}
 }
 
 func findRec(kvs []KV, key string) KV {
@@ -558,21 +1243,27 @@ func findRec(kvs []KV, key string) KV {
 // empty header for REST calls.
 var emptyHeader = make(http.Header)
 
-func (c *Conn) doREST(op string, key string, val []byte) (code int, body []byte, err error) {
+// doRESTCtx issues a single REST operation against the KT endpoint,
+// cancelling the request as soon as ctx is done.
+func (c *Conn) doRESTCtx(ctx context.Context, verb string, key string, val []byte) (code int, body []byte, err error) {
+	opLabel := "rest:" + verb
+	done := c.observeStart(opLabel)
+	defer func() { done(code, err) }()
+
 	newkey := urlenc(key)
 	url := &url.URL{
-		Scheme: "http",
+		Scheme: c.scheme,
 		Host:   c.host,
 		Opaque: newkey,
 	}
-	resp, t, err := c.roundTrip(op, url, emptyHeader, val)
+	resp, err := c.roundTripCtx(ctx, opLabel, verb, url, emptyHeader, val)
 	if err != nil {
 		return 0, nil, err
 	}
 	resultBody, err := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
-	if !t.Stop() {
-		err = ErrTimeout
+	if err != nil {
+		err = translateCtxErr(ctx, err)
 	}
 	return resp.StatusCode, resultBody, err
 }
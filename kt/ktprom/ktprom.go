@@ -0,0 +1,106 @@
+// Package ktprom is an out-of-the-box kt.Observer that exposes per-op
+// latency histograms, retry counts, and pool saturation to Prometheus.
+//
+// It lives in its own package so that importing kt doesn't pull in the
+// Prometheus client for callers who don't want it.
+package ktprom
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"www-go/golibs/kt"
+)
+
+// Observer is a kt.Observer/kt.ConnObserver that records metrics for a
+// single Conn. It implements prometheus.Collector, so it can be registered
+// directly with a prometheus.Registry.
+type Observer struct {
+	conn *kt.Conn
+
+	latency     *prometheus.HistogramVec
+	retries     *prometheus.CounterVec
+	connReused  *prometheus.CounterVec
+	poolSatDesc *prometheus.Desc
+}
+
+// New creates an Observer for conn. namespace/subsystem are used as the
+// usual Prometheus metric name prefix (e.g. "myapp", "kt").
+func New(conn *kt.Conn, namespace, subsystem string) *Observer {
+	return &Observer{
+		conn: conn,
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "rpc_latency_seconds",
+			Help:      "Latency of kt RPC/REST calls by op and outcome.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"op", "status"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "rpc_retries_total",
+			Help:      "Count of kt RPC/REST calls retried after the remote end closed an idle connection.",
+		}, []string{"op"}),
+		connReused: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "conn_reuse_total",
+			Help:      "Count of underlying connections obtained for a call, by whether they came from the idle pool.",
+		}, []string{"reused"}),
+		poolSatDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "pool_retries_total"),
+			"Cumulative retries due to idle connections being closed under load, a proxy for pool saturation since net/http.Transport doesn't expose active connection counts.",
+			nil, nil,
+		),
+	}
+}
+
+// RPCStart implements kt.Observer. Start isn't separately tracked today;
+// latency is derived from the duration RPCEnd reports.
+func (o *Observer) RPCStart(op string) {}
+
+// RPCEnd implements kt.Observer.
+//
+// kt reports logical failures (CAS mismatch, cur_jump miss, ...) as a non-2xx
+// code with err == nil — the *kt.Error is only built by the caller after
+// RPCEnd has already been invoked — so code must be consulted as well as err
+// to avoid mislabeling those as successes.
+func (o *Observer) RPCEnd(op string, code int, err error, dur time.Duration) {
+	status := "ok"
+	if err != nil || code < 200 || code >= 300 {
+		status = "error"
+	}
+	o.latency.WithLabelValues(op, status).Observe(dur.Seconds())
+}
+
+// Retry implements kt.Observer.
+func (o *Observer) Retry(op string) {
+	o.retries.WithLabelValues(op).Inc()
+}
+
+// GotConn implements kt.ConnObserver.
+func (o *Observer) GotConn(reused bool) {
+	label := "false"
+	if reused {
+		label = "true"
+	}
+	o.connReused.WithLabelValues(label).Inc()
+}
+
+// Describe implements prometheus.Collector.
+func (o *Observer) Describe(ch chan<- *prometheus.Desc) {
+	o.latency.Describe(ch)
+	o.retries.Describe(ch)
+	o.connReused.Describe(ch)
+	ch <- o.poolSatDesc
+}
+
+// Collect implements prometheus.Collector.
+func (o *Observer) Collect(ch chan<- prometheus.Metric) {
+	o.latency.Collect(ch)
+	o.retries.Collect(ch)
+	o.connReused.Collect(ch)
+	ch <- prometheus.MustNewConstMetric(o.poolSatDesc, prometheus.CounterValue, float64(o.conn.RetryCount()))
+}